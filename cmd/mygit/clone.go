@@ -1,14 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"compress/zlib"
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 )
 
@@ -28,90 +26,66 @@ func Clone(remoteRepo string, dir string) error {
 		return err
 	}
 
-	packfile, commit, err := getPackfile(remoteRepo)
+	session, err := NewUploadPackSession(remoteRepo)
 	if err != nil {
 		return err
 	}
 
-	err = writePackfile(packfile)
+	refs, defaultBranch := session.Refs()
+	want, err := resolveWant(refs, defaultBranch)
 	if err != nil {
 		return err
 	}
 
-	return checkoutCommit(commit)
-}
-
-func readPktLine(blob []byte) (int, []byte, error) {
-	pktLength := blob[:4]
-	blob = blob[4:]
-	dst := [2]byte{}
-	_, err := hex.Decode(dst[:], pktLength)
+	packfile, err := session.FetchPackfile(want)
 	if err != nil {
-		return 0, nil, err
-	}
-	size := uint16(dst[0])<<8 | uint16(dst[1])
-	if size == 0 {
-		return 4, []byte{}, nil
+		return err
 	}
-	if len(blob) < int(size)-4 {
-		return 4, nil, errors.New("error reading pkt line")
+	defer packfile.Close()
+
+	if err := writePackfile(packfile); err != nil {
+		return err
 	}
-	data := blob[:size-4]
-	if data[len(data)-1] == '\n' {
-		data = data[:len(data)-1]
+
+	if err := checkoutCommit(want); err != nil {
+		return err
 	}
-	return int(size), data, nil
+
+	return writeRefs(remoteRepo, refs, defaultBranch)
 }
 
-func getObjectName(pktLines [][]byte) (string, error) {
-	for _, pktLine := range pktLines[1:] {
-		if len(pktLine) == 0 {
-			continue
-		}
-		var hash, ref string
-		fmt.Sscanf(string(pktLine), "%s %s", &hash, &ref)
-		if ref == "refs/heads/master" {
+// resolveWant picks which commit to clone: the remote's default branch
+// (as reported by the HEAD symref) if known, otherwise refs/heads/master,
+// otherwise whatever HEAD points at directly.
+func resolveWant(refs map[string]string, defaultBranch string) (string, error) {
+	if defaultBranch != "" {
+		if hash, ok := refs["refs/heads/"+defaultBranch]; ok {
 			return hash, nil
 		}
 	}
-	return "", errors.New("invalid pktLines")
-}
-
-func getPackfile(cloneUrl string) ([]byte, string, error) {
-	response, err := http.Get(fmt.Sprintf("%s/info/refs?service=git-upload-pack", cloneUrl))
-	if err != nil {
-		return nil, "", err
-	}
-	discoveryBuffer := bytes.Buffer{}
-	io.Copy(&discoveryBuffer, response.Body)
-	discovery := discoveryBuffer.Bytes()
-	pktLines := [][]byte{}
-	for len(discovery) > 0 {
-		n, data, err := readPktLine(discovery)
-		if err != nil {
-			return nil, "", err
-		}
-		discovery = discovery[n:]
-		pktLines = append(pktLines, data)
+	if hash, ok := refs["refs/heads/master"]; ok {
+		return hash, nil
 	}
-	objectName, err := getObjectName(pktLines)
-	if err != nil {
-		return nil, "", err
+	if hash, ok := refs["HEAD"]; ok {
+		return hash, nil
 	}
-	buffer := bytes.NewBufferString(fmt.Sprintf("0032want %s\n00000009done\n", objectName))
-	response, err = http.Post(fmt.Sprintf("%s/git-upload-pack", cloneUrl), "application/x-git-upload-pack-request", buffer)
-	if err != nil {
-		return nil, "", err
-	}
-	packfileBuffer := bytes.Buffer{}
-	io.Copy(&packfileBuffer, response.Body)
-	packfile := packfileBuffer.Bytes()
-	n, _, err := readPktLine(packfile)
-	if err != nil {
-		return nil, "", err
-	}
-	packfile = packfile[n:]
-	return packfile, objectName, nil
+	return "", errors.New("no branch found to clone")
+}
+
+// packfileBody streams the rest of a v0 git-upload-pack response as raw
+// packfile bytes once fetchV0 has read off its leading pkt-line (the
+// "NAK" ack); Close closes the underlying HTTP response.
+type packfileBody struct {
+	r      *bufio.Reader
+	closer io.Closer
+}
+
+func (p *packfileBody) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func (p *packfileBody) Close() error {
+	return p.closer.Close()
 }
 
 type ObjectType int
@@ -125,32 +99,6 @@ const (
 	OBJ_REF_DELTA ObjectType = 7
 )
 
-func writeObjectWithType(object []byte, objectType string) ([]byte, error) {
-	blob := bytes.Buffer{}
-	fmt.Fprintf(&blob, "%s %d", objectType, len(object))
-	blob.WriteByte(0)
-	blob.Write(object)
-	return writeObject(blob.Bytes())
-}
-
-func readObjectHeader(packfile []byte) (size uint64, objectType ObjectType, used int, err error) {
-	data := packfile[used]
-	used++
-	objectType = ObjectType((data >> 4) & 0x7)
-	size = uint64(data & 0xF)
-	shift := 4
-	for data&0x80 != 0 {
-		if len(packfile) <= used || 64 <= shift {
-			return 0, ObjectType(0), 0, errors.New("bad object header")
-		}
-		data = packfile[used]
-		used++
-		size += uint64(data&0x7F) << shift
-		shift += 7
-	}
-	return size, objectType, used, nil
-}
-
 func readSize(packfile []byte) (size uint64, used int, err error) {
 	data := packfile[used]
 	used++
@@ -168,160 +116,213 @@ func readSize(packfile []byte) (size uint64, used int, err error) {
 	return size, used, nil
 }
 
-func readObjectInPackfile(packfile []byte) (int, []byte, error) {
-	b := bytes.NewReader(packfile)
-	r, err := zlib.NewReader(b)
-	if err != nil {
-		return 0, nil, err
-	}
-	defer r.Close()
-	object, err := io.ReadAll(r)
-	if err != nil {
-		return 0, nil, err
-	}
-	bytesRead := int(b.Size()) - b.Len()
-	return bytesRead, object, nil
-}
-
 type DeltaObject struct {
+	offset     int64
 	baseObject string
 	data       []byte
 }
 
-func verifyPackfile(packfile []byte) error {
-	if len(packfile) < 32 {
-		return errors.New("bad packfile")
-	}
-	checksum := packfile[len(packfile)-20:]
-	packfile = packfile[:len(packfile)-20]
-	expected := sha1.Sum(packfile)
-	if !bytes.Equal(checksum, expected[:]) {
-		return errors.New("invalid packfile checksum")
-	}
-	if !bytes.Equal(packfile[0:4], []byte("PACK")) {
-		return errors.New("invalid packfile header")
+// ofsDeltaObject is a pending OBJ_OFS_DELTA entry, keyed by the absolute
+// packfile offset of its base object rather than a SHA1.
+type ofsDeltaObject struct {
+	offset     int64
+	baseOffset int64
+	data       []byte
+}
+
+// resolvedObject holds the inflated bytes and type of an object that has
+// already been resolved. writePackfile keeps these in memory by the
+// absolute offset the object's header started at (and by hash), which
+// lets a chain of OFS_DELTA objects resolve without re-reading earlier
+// objects from disk.
+type resolvedObject struct {
+	objectType string
+	data       []byte
+}
+
+func writePackfile(r io.Reader) error {
+	if err := os.MkdirAll(".git/objects/pack", 0755); err != nil {
+		return fmt.Errorf("error on creating pack dir: %v", err)
 	}
-	version := readUint32BigEndian(packfile[4:8])
-	if version != 2 && version != 3 {
-		return errors.New("invalid packfile version")
+	tmpPack, err := os.CreateTemp(".git/objects/pack", "incoming-*.pack")
+	if err != nil {
+		return fmt.Errorf("error on creating temp packfile: %v", err)
 	}
-	return nil
-}
+	tmpPackPath := tmpPack.Name()
+	defer os.Remove(tmpPackPath)
+	defer tmpPack.Close()
 
-func writePackfile(packfile []byte) error {
-	err := verifyPackfile(packfile)
+	scanner, err := NewPackfileScanner(io.TeeReader(r, tmpPack))
 	if err != nil {
 		return err
 	}
-	used := 8
-	numObjects := readUint32BigEndian(packfile[used:])
-	used += 4
 	deltaObjects := []DeltaObject{}
+	ofsDeltaObjects := []ofsDeltaObject{}
+	resolvedObjects := map[int64]resolvedObject{}
+	resolvedByHash := map[string]resolvedObject{}
+	entries := map[int64]packEntry{}
 	var objectsRead uint32
-	packfile = packfile[:len(packfile)-20]
-	for used < len(packfile) {
+	for {
+		header, objectReader, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
 		objectsRead++
-		size, objectType, read, err := readObjectHeader(packfile[used:])
-		used += read
+		object, err := io.ReadAll(objectReader)
 		if err != nil {
 			return err
 		}
-		if objectType == OBJ_COMMIT || objectType == OBJ_TREE || objectType == OBJ_BLOB || objectType == OBJ_TAG {
-			read, object, err := readObjectInPackfile(packfile[used:])
-			used += read
-			if err != nil {
-				return err
-			}
-			if int(size) != len(object) {
-				return errors.New("bad object header length")
-			}
+		if uint64(len(object)) != header.Size {
+			return errors.New("bad object header length")
+		}
+		switch header.Type {
+		case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
 			objectTypeStr := map[ObjectType]string{
 				OBJ_COMMIT: "commit",
 				OBJ_TREE:   "tree",
 				OBJ_BLOB:   "blob",
 				OBJ_TAG:    "tag",
-			}[objectType]
-			_, err = writeObjectWithType(object, objectTypeStr)
-			if err != nil {
-				return err
-			}
-		} else if objectType == OBJ_OFS_DELTA {
-			_, read, err := readSize(packfile[used:])
-			used += read
-			if err != nil {
-				return err
-			}
-			read, object, err := readObjectInPackfile(packfile[used:])
-			used += read
-			if err != nil {
-				return err
-			}
-			if int(size) != len(object) {
-				return errors.New("bad object header length")
-			}
-			return errors.New("cant handle ofsdelta object")
-		} else if objectType == OBJ_REF_DELTA {
-			hash := packfile[used : used+20]
-			used += 20
-			read, object, err := readObjectInPackfile(packfile[used:])
-			used += read
-			if err != nil {
-				return err
-			}
-			if int(size) != len(object) {
-				return errors.New("bad object header length")
-			}
-			deltaObjects = append(deltaObjects, DeltaObject{baseObject: hex.EncodeToString(hash), data: object})
-		} else {
+			}[header.Type]
+			hash := hashObject(objectTypeStr, object)
+			resolved := resolvedObject{objectType: objectTypeStr, data: object}
+			resolvedObjects[header.Offset] = resolved
+			resolvedByHash[hexDump(hash)] = resolved
+			entries[header.Offset] = packEntry{offset: header.Offset, hash: hash}
+		case OBJ_OFS_DELTA:
+			ofsDeltaObjects = append(ofsDeltaObjects, ofsDeltaObject{
+				offset:     header.Offset,
+				baseOffset: header.BaseOffset,
+				data:       object,
+			})
+		case OBJ_REF_DELTA:
+			deltaObjects = append(deltaObjects, DeltaObject{offset: header.Offset, baseObject: header.BaseHash, data: object})
+		default:
 			return errors.New("invalid object type")
 		}
 	}
-	if numObjects != objectsRead {
+	if scanner.NumObjects() != objectsRead {
 		return errors.New("bad object count")
 	}
-	for len(deltaObjects) > 0 {
+	if err := scanner.Checksum(); err != nil {
+		return err
+	}
+
+	for len(deltaObjects) > 0 || len(ofsDeltaObjects) > 0 {
 		unaddedDeltaObjects := []DeltaObject{}
+		unaddedOfsDeltaObjects := []ofsDeltaObject{}
 		added := false
 		for _, delta := range deltaObjects {
-			if objectExists(delta.baseObject) {
-				added = true
-				baseObject, objectType, err := openObject(delta.baseObject)
-				if err != nil {
-					return err
-				}
-				err = writeDeltaObject(baseObject, delta.data, objectType)
-				if err != nil {
-					return err
-				}
-			} else {
+			base, ok := resolveBase(delta.baseObject, resolvedByHash)
+			if !ok {
 				unaddedDeltaObjects = append(unaddedDeltaObjects, delta)
+				continue
+			}
+			added = true
+			object, err := applyDelta(base.data, delta.data)
+			if err != nil {
+				return err
+			}
+			hash := hashObject(base.objectType, object)
+			resolved := resolvedObject{objectType: base.objectType, data: object}
+			resolvedObjects[delta.offset] = resolved
+			resolvedByHash[hexDump(hash)] = resolved
+			entries[delta.offset] = packEntry{offset: delta.offset, hash: hash}
+		}
+		for _, delta := range ofsDeltaObjects {
+			base, ok := resolvedObjects[delta.baseOffset]
+			if !ok {
+				unaddedOfsDeltaObjects = append(unaddedOfsDeltaObjects, delta)
+				continue
 			}
+			added = true
+			object, err := applyDelta(base.data, delta.data)
+			if err != nil {
+				return err
+			}
+			hash := hashObject(base.objectType, object)
+			resolved := resolvedObject{objectType: base.objectType, data: object}
+			resolvedObjects[delta.offset] = resolved
+			resolvedByHash[hexDump(hash)] = resolved
+			entries[delta.offset] = packEntry{offset: delta.offset, hash: hash}
 		}
 		if !added {
 			return errors.New("bad delta objects")
 		}
 		deltaObjects = unaddedDeltaObjects
+		ofsDeltaObjects = unaddedOfsDeltaObjects
+	}
+
+	packPath, err := finalizePackfile(tmpPackPath, scanner.Sum(), entries)
+	if err != nil {
+		return err
 	}
+	idxPath := packPath[:len(packPath)-len(".pack")] + ".idx"
+	index, err := NewPackIndex(idxPath)
+	if err != nil {
+		return err
+	}
+	objectStorage = compositeStorage{packed: newPackedStorage(packPath, index)}
 	return nil
 }
 
+// resolveBase looks up a REF_DELTA's base object, first among what this
+// pack has already resolved in memory and, for thin packs whose base
+// lives outside the pack, by falling back to objectStorage.
+func resolveBase(hash string, resolvedByHash map[string]resolvedObject) (resolvedObject, bool) {
+	if obj, ok := resolvedByHash[hash]; ok {
+		return obj, true
+	}
+	if !objectStorage.HasObject(hash) {
+		return resolvedObject{}, false
+	}
+	data, objectType, err := objectStorage.GetObject(hash)
+	if err != nil {
+		return resolvedObject{}, false
+	}
+	return resolvedObject{objectType: objectType, data: data}, true
+}
+
+// finalizePackfile moves the temporary packfile to its content-addressed
+// name (pack-<sha>.pack, where sha is the packfile's own trailing
+// checksum), writes the matching .idx alongside it, and returns the
+// pack's final path.
+func finalizePackfile(tmpPackPath string, packSha []byte, entries map[int64]packEntry) (string, error) {
+	packPath := fmt.Sprintf(".git/objects/pack/pack-%s.pack", hex.EncodeToString(packSha))
+	if err := os.Rename(tmpPackPath, packPath); err != nil {
+		return "", fmt.Errorf("error on finalizing packfile: %v", err)
+	}
+	entryList := make([]packEntry, 0, len(entries))
+	for _, e := range entries {
+		entryList = append(entryList, e)
+	}
+	if err := writePackIndex(packPath, packSha, entryList); err != nil {
+		return "", err
+	}
+	return packPath, nil
+}
+
 func readUint32BigEndian(bytes []byte) uint32 {
 	return uint32(bytes[0])<<24 | uint32(bytes[1])<<16 | uint32(bytes[2])<<8 | uint32(bytes[3])
 }
 
-func writeDeltaObject(baseObject, deltaObject []byte, objectType string) error {
+// applyDelta patches baseObject against a git delta instruction stream,
+// shared by both OBJ_REF_DELTA and OBJ_OFS_DELTA resolution.
+func applyDelta(baseObject, deltaObject []byte) ([]byte, error) {
 	used := 0
 	baseSize, read, err := readSize(deltaObject[used:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	used += read
 	if len(baseObject) != int(baseSize) {
-		return errors.New("bad delta header")
+		return nil, errors.New("bad delta header")
 	}
 	expectedSize, read, err := readSize(deltaObject[used:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	used += read
 	buffer := bytes.Buffer{}
@@ -350,38 +351,13 @@ func writeDeltaObject(baseObject, deltaObject []byte, objectType string) error {
 	}
 	undeltifiedObject := buffer.Bytes()
 	if int(expectedSize) != len(undeltifiedObject) {
-		return errors.New("bad delta header")
-	}
-	_, err = writeObjectWithType(undeltifiedObject, objectType)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func objectExists(hash string) bool {
-	path := fmt.Sprintf(".git/objects/%s/%s", hash[:2], hash[2:])
-	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
-		return false
+		return nil, errors.New("bad delta header")
 	}
-	return true
+	return undeltifiedObject, nil
 }
 
 func openObject(object string) ([]byte, string, error) {
-	objectData, err := readObject(object)
-	if err != nil {
-		return nil, "", err
-	}
-	idx := bytes.IndexByte(objectData, 0)
-	var (
-		objectType string
-		size       int
-	)
-	fmt.Sscanf(string(objectData[:idx]), "%s %d", &objectType, &size)
-	if idx+size+1 != len(objectData) {
-		return nil, "", errors.New("bad object size")
-	}
-	return objectData[idx+1:], objectType, nil
+	return objectStorage.GetObject(object)
 }
 
 func checkoutCommit(commitHash string) error {
@@ -398,6 +374,18 @@ func checkoutCommit(commitHash string) error {
 }
 
 func checkoutTree(tree string, dir string) error {
+	indexEntries := []*IndexEntry{}
+	if err := checkoutTreeEntries(tree, dir, "", &indexEntries); err != nil {
+		return err
+	}
+	return writeIndex(indexEntries)
+}
+
+// checkoutTreeEntries writes out tree to dir, recording an IndexEntry for
+// every blob it writes so the caller can populate .git/index once the
+// whole checkout is done. prefix is the entry's path relative to the
+// worktree root (independent of dir, which is the filesystem path).
+func checkoutTreeEntries(tree string, dir string, prefix string, indexEntries *[]*IndexEntry) error {
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return err
@@ -409,8 +397,9 @@ func checkoutTree(tree string, dir string) error {
 	for _, entry := range entries {
 		hashStr := hex.EncodeToString(entry.hash[:])
 		fullPath := fmt.Sprintf("%s/%s", dir, entry.name)
+		indexPath := prefix + entry.name
 		if entry.mode == "40000" {
-			err = checkoutTree(hashStr, fullPath)
+			err = checkoutTreeEntries(hashStr, fullPath, indexPath+"/", indexEntries)
 			if err != nil {
 				return err
 			}
@@ -422,7 +411,18 @@ func checkoutTree(tree string, dir string) error {
 			if objectType != "blob" {
 				return errors.New("object not a blob")
 			}
-			os.WriteFile(fullPath, blob, 0644)
+			fileMode, err := modeFromTreeEntryMode(entry.mode)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(fullPath, blob, os.FileMode(fileMode&0777)); err != nil {
+				return err
+			}
+			indexEntry, err := newIndexEntry(indexPath, fullPath, entry.hash, fileMode)
+			if err != nil {
+				return err
+			}
+			*indexEntries = append(*indexEntries, indexEntry)
 		}
 	}
 	return nil
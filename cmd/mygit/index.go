@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type IndexEntry struct {
+	ctimeSec, ctimeNsec uint32
+	mtimeSec, mtimeNsec uint32
+	dev, ino            uint32
+	mode                uint32
+	uid, gid            uint32
+	size                uint32
+	hash                []byte
+	path                string
+}
+
+func newIndexEntry(path string, fullPath string, hash []byte, mode uint32) (*IndexEntry, error) {
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.New("unsupported platform for index stat info")
+	}
+	return &IndexEntry{
+		ctimeSec:  uint32(stat.Ctim.Sec),
+		ctimeNsec: uint32(stat.Ctim.Nsec),
+		mtimeSec:  uint32(stat.Mtim.Sec),
+		mtimeNsec: uint32(stat.Mtim.Nsec),
+		dev:       uint32(stat.Dev),
+		ino:       uint32(stat.Ino),
+		mode:      mode,
+		uid:       stat.Uid,
+		gid:       stat.Gid,
+		size:      uint32(fi.Size()),
+		hash:      hash,
+		path:      path,
+	}, nil
+}
+
+func modeFromTreeEntryMode(mode string) (uint32, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad tree entry mode: %v", err)
+	}
+	return uint32(m), nil
+}
+
+const indexPath = ".git/index"
+
+func writeIndex(entries []*IndexEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	buf := bytes.Buffer{}
+	buf.WriteString("DIRC")
+	writeUint32BigEndian(&buf, 2)
+	writeUint32BigEndian(&buf, uint32(len(entries)))
+
+	for _, e := range entries {
+		start := buf.Len()
+		writeUint32BigEndian(&buf, e.ctimeSec)
+		writeUint32BigEndian(&buf, e.ctimeNsec)
+		writeUint32BigEndian(&buf, e.mtimeSec)
+		writeUint32BigEndian(&buf, e.mtimeNsec)
+		writeUint32BigEndian(&buf, e.dev)
+		writeUint32BigEndian(&buf, e.ino)
+		writeUint32BigEndian(&buf, e.mode)
+		writeUint32BigEndian(&buf, e.uid)
+		writeUint32BigEndian(&buf, e.gid)
+		writeUint32BigEndian(&buf, e.size)
+		buf.Write(e.hash)
+
+		nameLen := len(e.path)
+		flags := nameLen
+		if flags > 0xFFF {
+			flags = 0xFFF
+		}
+		buf.WriteByte(byte(flags >> 8))
+		buf.WriteByte(byte(flags))
+
+		buf.WriteString(e.path)
+		buf.WriteByte(0)
+		for (buf.Len()-start)%8 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+
+	return os.WriteFile(indexPath, buf.Bytes(), 0644)
+}
+
+func readIndex() ([]*IndexEntry, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12+20 || string(data[0:4]) != "DIRC" {
+		return nil, errors.New("bad index file")
+	}
+	version := readUint32BigEndian(data[4:8])
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	count := readUint32BigEndian(data[8:12])
+
+	entries := make([]*IndexEntry, 0, count)
+	offset := 12
+	for i := uint32(0); i < count; i++ {
+		start := offset
+		e := &IndexEntry{
+			ctimeSec:  readUint32BigEndian(data[offset : offset+4]),
+			ctimeNsec: readUint32BigEndian(data[offset+4 : offset+8]),
+			mtimeSec:  readUint32BigEndian(data[offset+8 : offset+12]),
+			mtimeNsec: readUint32BigEndian(data[offset+12 : offset+16]),
+			dev:       readUint32BigEndian(data[offset+16 : offset+20]),
+			ino:       readUint32BigEndian(data[offset+20 : offset+24]),
+			mode:      readUint32BigEndian(data[offset+24 : offset+28]),
+			uid:       readUint32BigEndian(data[offset+28 : offset+32]),
+			gid:       readUint32BigEndian(data[offset+32 : offset+36]),
+			size:      readUint32BigEndian(data[offset+36 : offset+40]),
+		}
+		e.hash = append([]byte{}, data[offset+40:offset+60]...)
+		flags := uint16(data[offset+60])<<8 | uint16(data[offset+61])
+		nameLen := int(flags & 0xFFF)
+		nameStart := offset + 62
+		e.path = string(data[nameStart : nameStart+nameLen])
+		offset = nameStart + nameLen + 1 // +1 for the NUL terminator
+		for (offset-start)%8 != 0 {
+			offset++
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func treeFromIndex(entries []*IndexEntry) ([]byte, error) {
+	type node struct {
+		entry    *IndexEntry
+		children map[string]*node
+	}
+	root := &node{children: map[string]*node{}}
+	for _, e := range entries {
+		parts := strings.Split(e.path, "/")
+		cur := root
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := cur.children[part]
+			if !ok {
+				child = &node{children: map[string]*node{}}
+				cur.children[part] = child
+			}
+			cur = child
+		}
+		cur.children[parts[len(parts)-1]] = &node{entry: e}
+	}
+
+	var writeNode func(n *node) ([]byte, error)
+	writeNode = func(n *node) ([]byte, error) {
+		treeEntries := make([]*TreeEntry, 0, len(n.children))
+		for name, child := range n.children {
+			if child.entry != nil {
+				treeEntries = append(treeEntries, &TreeEntry{
+					name: name,
+					hash: child.entry.hash,
+					mode: fmt.Sprintf("%o", child.entry.mode),
+				})
+				continue
+			}
+			hash, err := writeNode(child)
+			if err != nil {
+				return nil, err
+			}
+			treeEntries = append(treeEntries, &TreeEntry{
+				name: name,
+				hash: hash,
+				mode: TreeEntryModeTree,
+			})
+		}
+		sort.SliceStable(treeEntries, func(i, j int) bool { return treeEntries[i].name < treeEntries[j].name })
+
+		buf := make([]byte, 0)
+		for _, entry := range treeEntries {
+			buf = append(buf, entry.Bytes()...)
+		}
+		return objectStorage.PutObject("tree", buf)
+	}
+
+	return writeNode(root)
+}
@@ -12,58 +12,16 @@ import (
 	"sort"
 )
 
-func readObject(object string) ([]byte, error) {
-	dir, file := splitDirFile(object)
-	b, err := os.ReadFile(filepath.Join(".git/objects", dir, file))
-	if err != nil {
-		return nil, fmt.Errorf("error on reading object file: %v", err)
-	}
-
-	objectData, err := unzip(b)
-	if err != nil {
-		return nil, fmt.Errorf("error on unzipping object file: %v", err)
-	}
-
-	return objectData, nil
-}
-
-func writeObject(objectData []byte) ([]byte, error) {
-	zippedData, err := zip(objectData)
-	if err != nil {
-		return nil, fmt.Errorf("error on zipping blob object: %v", err)
-	}
-
-	object := hash(objectData)
-	dir, file := splitDirFile(hexDump(object))
-	if err := os.Mkdir(filepath.Join(".git/objects", dir), 0644); err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("error on creating object dir: %v", err)
-	}
-	f, err := os.OpenFile(filepath.Join(".git/objects", dir, file), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("error on opening object file: %v", err)
-	}
-	defer f.Close()
-
-	_, err = io.CopyBuffer(f, bytes.NewReader(zippedData), make([]byte, 512))
-	if err != nil {
-		return nil, fmt.Errorf("error on writing object file: %v", err)
-	}
-
-	return object, nil
-}
-
 func readBlobContent(object string) (string, error) {
-	blob, err := readObject(object)
+	content, objectType, err := objectStorage.GetObject(object)
 	if err != nil {
 		return "", err
 	}
-
-	content, err := parseBlobContent(blob)
-	if err != nil {
-		return "", fmt.Errorf("error on extracting blob file: %v", err)
+	if objectType != "blob" {
+		return "", errors.New("object not a blob")
 	}
 
-	return content, nil
+	return string(content), nil
 }
 
 func writeBlob(filePath string) ([]byte, error) {
@@ -73,20 +31,32 @@ func writeBlob(filePath string) ([]byte, error) {
 		os.Exit(1)
 	}
 
-	blob := blobObject(content)
-	return writeObject(blob)
+	return objectStorage.PutObject("blob", content)
 }
 
 func readTree(object string) ([]*TreeEntry, error) {
-	treeData, err := readObject(object)
+	content, objectType, err := objectStorage.GetObject(object)
 	if err != nil {
 		return nil, err
 	}
+	if objectType != "tree" {
+		return nil, errors.New("object not a tree")
+	}
 
-	return parseTree(treeData)
+	return parseTree(content)
 }
 
+// writeTree builds a tree object for dir. When dir is the worktree root
+// and .git/index exists, it builds the tree from the index instead (so
+// write-tree reflects what's staged, not just what's on disk); otherwise
+// it falls back to walking the filesystem.
 func writeTree(dir string) ([]byte, error) {
+	if dir == "." {
+		if indexEntries, err := readIndex(); err == nil {
+			return treeFromIndex(indexEntries)
+		}
+	}
+
 	dirEntries, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
@@ -135,15 +105,11 @@ func writeTree(dir string) ([]byte, error) {
 		buf = append(buf, entry.Bytes()...)
 	}
 
-	header := fmt.Sprintf("tree %d\x00", len(buf))
-
-	treeData := append([]byte(header), buf...)
-	return writeObject(treeData)
+	return objectStorage.PutObject("tree", buf)
 }
 
 func writeCommit(commit *Commit) ([]byte, error) {
-	objectData := commit.Bytes()
-	return writeObject(objectData)
+	return objectStorage.PutObject("commit", commit.Bytes())
 }
 
 func unzip(b []byte) ([]byte, error) {
@@ -174,21 +140,6 @@ func zip(b []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func parseBlobContent(b []byte) (string, error) {
-	// blob <size>\x00<content>
-	i := bytes.IndexByte(b, 0)
-	if i < 0 {
-		return "", errors.New("cannot extract blob content")
-	}
-
-	return string(b[i+1:]), nil
-}
-
-func blobObject(b []byte) []byte {
-	header := fmt.Sprintf("blob %d\x00", len(b))
-	return append([]byte(header), b...)
-}
-
 type TreeEntry struct {
 	hash []byte
 	name string
@@ -211,7 +162,7 @@ const (
 )
 
 func parseTree(b []byte) ([]*TreeEntry, error) {
-	offset := bytes.IndexByte(b, 0) + 1
+	offset := 0
 	entries := make([]*TreeEntry, 0)
 	for offset < len(b) {
 		entry, skipN, err := parseTreeEntry(b[offset:])
@@ -260,9 +211,7 @@ func (c *Commit) Bytes() []byte {
 	buf.WriteString(fmt.Sprintf("committer %s %s\n", c.committer.name, c.committer.email))
 	buf.WriteString(fmt.Sprintf("\n%s\n", c.message))
 
-	header := fmt.Sprintf("commit %d\x00", buf.Len())
-
-	return append([]byte(header), buf.Bytes()...)
+	return buf.Bytes()
 }
 
 type User struct {
@@ -275,6 +224,13 @@ func hash(b []byte) []byte {
 	return h[:]
 }
 
+// hashObject computes the SHA1 an object would have once stored, without
+// actually storing it: the hash of "<type> <len>\x00<content>".
+func hashObject(objectType string, content []byte) []byte {
+	header := fmt.Sprintf("%s %d\x00", objectType, len(content))
+	return hash(append([]byte(header), content...))
+}
+
 func hexDump(b []byte) string {
 	return fmt.Sprintf("%x", b)
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	hashpkg "hash"
+	"io"
+)
+
+type ObjectHeader struct {
+	Offset     int64
+	Type       ObjectType
+	Size       uint64
+	BaseOffset int64
+	BaseHash   string
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type trailerHasher struct {
+	hash   hashpkg.Hash
+	window []byte
+}
+
+func newTrailerHasher() *trailerHasher {
+	return &trailerHasher{hash: sha1.New()}
+}
+
+func (t *trailerHasher) Write(p []byte) (int, error) {
+	t.window = append(t.window, p...)
+	if overflow := len(t.window) - 20; overflow > 0 {
+		t.hash.Write(t.window[:overflow])
+		t.window = t.window[overflow:]
+	}
+	return len(p), nil
+}
+
+type PackfileScanner struct {
+	counting    *countingReader
+	buffered    *bufio.Reader
+	trailer     *trailerHasher
+	numObjects  uint32
+	objectsRead uint32
+}
+
+func NewPackfileScanner(r io.Reader) (*PackfileScanner, error) {
+	trailer := newTrailerHasher()
+	counting := &countingReader{r: io.TeeReader(r, trailer)}
+	buffered := bufio.NewReader(counting)
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(buffered, header); err != nil {
+		return nil, errors.New("bad packfile")
+	}
+	if string(header[0:4]) != "PACK" {
+		return nil, errors.New("invalid packfile header")
+	}
+	version := readUint32BigEndian(header[4:8])
+	if version != 2 && version != 3 {
+		return nil, errors.New("invalid packfile version")
+	}
+	countBuf := make([]byte, 4)
+	if _, err := io.ReadFull(buffered, countBuf); err != nil {
+		return nil, errors.New("bad packfile")
+	}
+
+	return &PackfileScanner{
+		counting:   counting,
+		buffered:   buffered,
+		trailer:    trailer,
+		numObjects: readUint32BigEndian(countBuf),
+	}, nil
+}
+
+func (s *PackfileScanner) Position() int64 {
+	return s.counting.n - int64(s.buffered.Buffered())
+}
+
+func (s *PackfileScanner) NumObjects() uint32 {
+	return s.numObjects
+}
+
+func (s *PackfileScanner) Next() (*ObjectHeader, io.Reader, error) {
+	if s.objectsRead >= s.numObjects {
+		return nil, nil, io.EOF
+	}
+
+	offset := s.Position()
+	size, objectType, err := readObjectHeaderFrom(s.buffered)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := &ObjectHeader{Offset: offset, Type: objectType, Size: size}
+	switch objectType {
+	case OBJ_OFS_DELTA:
+		ofs, err := readOfsDeltaOffsetFrom(s.buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.BaseOffset = offset - int64(ofs)
+	case OBJ_REF_DELTA:
+		hashBuf := make([]byte, 20)
+		if _, err := io.ReadFull(s.buffered, hashBuf); err != nil {
+			return nil, nil, err
+		}
+		header.BaseHash = hex.EncodeToString(hashBuf)
+	}
+
+	zr, err := zlib.NewReader(s.buffered)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.objectsRead++
+	return header, zr, nil
+}
+
+func (s *PackfileScanner) Checksum() error {
+	if _, err := io.Copy(io.Discard, s.buffered); err != nil {
+		return err
+	}
+	if len(s.trailer.window) != 20 {
+		return errors.New("bad packfile")
+	}
+	if !bytes.Equal(s.trailer.hash.Sum(nil), s.trailer.window) {
+		return errors.New("invalid packfile checksum")
+	}
+	return nil
+}
+
+func (s *PackfileScanner) Sum() []byte {
+	return s.trailer.window
+}
+
+func readObjectHeaderFrom(r *bufio.Reader) (size uint64, objectType ObjectType, err error) {
+	data, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	objectType = ObjectType((data >> 4) & 0x7)
+	size = uint64(data & 0xF)
+	shift := 4
+	for data&0x80 != 0 {
+		if shift >= 64 {
+			return 0, 0, errors.New("bad object header")
+		}
+		data, err = r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		size += uint64(data&0x7F) << shift
+		shift += 7
+	}
+	return size, objectType, nil
+}
+
+func readOfsDeltaOffsetFrom(r *bufio.Reader) (offset uint64, err error) {
+	data, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offset = uint64(data & 0x7f)
+	for data&0x80 != 0 {
+		data, err = r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		offset = ((offset + 1) << 7) | uint64(data&0x7f)
+	}
+	return offset, nil
+}
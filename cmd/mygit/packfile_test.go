@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"testing"
+)
+
+// --- test-only packfile encoding helpers, mirroring the decoders in
+// packfile_scanner.go and clone.go (readObjectHeaderFrom, readOfsDeltaOffsetFrom,
+// readSize, applyDelta) so this file can build a packfile byte-for-byte. ---
+
+func encodeObjectHeader(t ObjectType, size uint64) []byte {
+	b0 := byte(size&0xF) | (byte(t)<<4)&0x70
+	size >>= 4
+	out := []byte{}
+	if size > 0 {
+		b0 |= 0x80
+	}
+	out = append(out, b0)
+	for size > 0 {
+		b := byte(size & 0x7f)
+		size >>= 7
+		if size > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func encodeOfsDeltaOffset(offset uint64) []byte {
+	var rev []byte
+	rev = append(rev, byte(offset&0x7f))
+	offset >>= 7
+	for offset != 0 {
+		offset--
+		rev = append(rev, 0x80|byte(offset&0x7f))
+		offset >>= 7
+	}
+	out := make([]byte, len(rev))
+	for i, b := range rev {
+		out[len(rev)-1-i] = b
+	}
+	return out
+}
+
+func encodeDeltaSize(size uint64) []byte {
+	out := []byte{}
+	b := byte(size & 0x7f)
+	size >>= 7
+	for size > 0 {
+		out = append(out, b|0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(out, b)
+}
+
+// encodeCopyOp builds a delta copy instruction that copies size bytes
+// starting at offset out of the base object. Both must fit in a byte,
+// which is all the test deltas below need.
+func encodeCopyOp(offset, size byte) []byte {
+	return []byte{0x80 | 0x01 | 0x10, offset, size}
+}
+
+func encodeInsertOp(data []byte) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+// buildDelta assembles a delta instruction stream: base size, target size,
+// then the copy/insert ops, in the format applyDelta expects.
+func buildDelta(baseSize, targetSize uint64, ops ...[]byte) []byte {
+	buf := bytes.Buffer{}
+	buf.Write(encodeDeltaSize(baseSize))
+	buf.Write(encodeDeltaSize(targetSize))
+	for _, op := range ops {
+		buf.Write(op)
+	}
+	return buf.Bytes()
+}
+
+// packObject is one entry to be packed by buildTestPackfile. baseIndex is
+// only meaningful for OBJ_OFS_DELTA, referencing another entry in objects
+// by position; baseHash is only meaningful for OBJ_REF_DELTA.
+type packObject struct {
+	objectType ObjectType
+	content    []byte
+	baseIndex  int
+	baseHash   []byte
+}
+
+// buildTestPackfile encodes objects into a minimal valid packfile,
+// resolving each OFS_DELTA's relative offset from its base's already-known
+// position and appending the trailing SHA1 checksum, the same way a real
+// git-upload-pack response would.
+func buildTestPackfile(t *testing.T, objects []packObject) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	buf.WriteString("PACK")
+	writeUint32BigEndian(&buf, 2)
+	writeUint32BigEndian(&buf, uint32(len(objects)))
+
+	offsets := make([]int64, len(objects))
+	for i, obj := range objects {
+		offsets[i] = int64(buf.Len())
+		buf.Write(encodeObjectHeader(obj.objectType, uint64(len(obj.content))))
+		switch obj.objectType {
+		case OBJ_OFS_DELTA:
+			buf.Write(encodeOfsDeltaOffset(uint64(offsets[i] - offsets[obj.baseIndex])))
+		case OBJ_REF_DELTA:
+			buf.Write(obj.baseHash)
+		}
+		compressed, err := zip(obj.content)
+		if err != nil {
+			t.Fatalf("zip: %v", err)
+		}
+		buf.Write(compressed)
+	}
+
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// chdirTemp switches the working directory to a fresh temp dir for the
+// duration of the test, restoring both the directory and objectStorage
+// (writePackfile mutates the package-level var) on cleanup.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	prevWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevStorage := objectStorage
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(prevWd)
+		objectStorage = prevStorage
+	})
+}
+
+// TestWritePackfileMultiLevelOfsAndRefDelta builds a packfile with a
+// two-level OFS_DELTA chain (a delta of a delta) plus a REF_DELTA in the
+// same pack, and checks writePackfile resolves every object correctly
+// through the resulting packedStorage.
+func TestWritePackfileMultiLevelOfsAndRefDelta(t *testing.T) {
+	chdirTemp(t)
+
+	baseContent := []byte("hello")
+	baseHash := hashObject("blob", baseContent)
+
+	level1Content := []byte("hello world")    // base -> level1
+	level2Content := []byte("hello world!!!") // level1 -> level2
+	refTargetContent := []byte("hello!")      // base -> ref delta
+
+	objects := []packObject{
+		{objectType: OBJ_BLOB, content: baseContent},
+		{objectType: OBJ_OFS_DELTA, baseIndex: 0, content: buildDelta(
+			uint64(len(baseContent)), uint64(len(level1Content)),
+			encodeCopyOp(0, 5), encodeInsertOp([]byte(" world")))},
+		{objectType: OBJ_OFS_DELTA, baseIndex: 1, content: buildDelta(
+			uint64(len(level1Content)), uint64(len(level2Content)),
+			encodeCopyOp(0, 11), encodeInsertOp([]byte("!!!")))},
+		{objectType: OBJ_REF_DELTA, baseHash: baseHash, content: buildDelta(
+			uint64(len(baseContent)), uint64(len(refTargetContent)),
+			encodeCopyOp(0, 5), encodeInsertOp([]byte("!")))},
+	}
+
+	packed := buildTestPackfile(t, objects)
+	if err := writePackfile(bytes.NewReader(packed)); err != nil {
+		t.Fatalf("writePackfile: %v", err)
+	}
+
+	cases := []struct {
+		hash []byte
+		want string
+	}{
+		{baseHash, "hello"},
+		{hashObject("blob", level1Content), "hello world"},
+		{hashObject("blob", level2Content), "hello world!!!"},
+		{hashObject("blob", refTargetContent), "hello!"},
+	}
+	for _, c := range cases {
+		data, objectType, err := objectStorage.GetObject(hexDump(c.hash))
+		if err != nil {
+			t.Fatalf("GetObject(%x): %v", c.hash, err)
+		}
+		if objectType != "blob" {
+			t.Fatalf("GetObject(%x): type = %q, want blob", c.hash, objectType)
+		}
+		if string(data) != c.want {
+			t.Fatalf("GetObject(%x) = %q, want %q", c.hash, data, c.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+var idxMagic = []byte{0xff, 't', 'O', 'c'}
+
+type packEntry struct {
+	offset int64
+	hash   []byte
+}
+
+func writePackIndex(packPath string, packSha []byte, entries []packEntry) error {
+	pack, err := os.Open(packPath)
+	if err != nil {
+		return fmt.Errorf("error on opening packfile: %v", err)
+	}
+	defer pack.Close()
+
+	info, err := pack.Stat()
+	if err != nil {
+		return err
+	}
+	packSize := info.Size()
+
+	byOffset := make([]packEntry, len(entries))
+	copy(byOffset, entries)
+	sort.Slice(byOffset, func(i, j int) bool { return byOffset[i].offset < byOffset[j].offset })
+
+	crc32s := make(map[int64]uint32, len(byOffset))
+	for i, e := range byOffset {
+		end := packSize - 20
+		if i+1 < len(byOffset) {
+			end = byOffset[i+1].offset
+		}
+		raw := make([]byte, end-e.offset)
+		if _, err := pack.ReadAt(raw, e.offset); err != nil {
+			return fmt.Errorf("error on reading packfile entry: %v", err)
+		}
+		crc32s[e.offset] = crc32.ChecksumIEEE(raw)
+	}
+
+	sorted := make([]packEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].hash, sorted[j].hash) < 0 })
+
+	buf := bytes.Buffer{}
+	buf.Write(idxMagic)
+	writeUint32BigEndian(&buf, 2)
+
+	var fanout [256]uint32
+	for _, e := range sorted {
+		fanout[e.hash[0]]++
+	}
+	var cumulative uint32
+	for i := range fanout {
+		cumulative += fanout[i]
+		fanout[i] = cumulative
+	}
+	for _, count := range fanout {
+		writeUint32BigEndian(&buf, count)
+	}
+
+	for _, e := range sorted {
+		buf.Write(e.hash)
+	}
+	for _, e := range sorted {
+		writeUint32BigEndian(&buf, crc32s[e.offset])
+	}
+
+	largeOffsets := []int64{}
+	for _, e := range sorted {
+		if e.offset >= 1<<31 {
+			writeUint32BigEndian(&buf, uint32(0x80000000|len(largeOffsets)))
+			largeOffsets = append(largeOffsets, e.offset)
+		} else {
+			writeUint32BigEndian(&buf, uint32(e.offset))
+		}
+	}
+	for _, offset := range largeOffsets {
+		writeUint64BigEndian(&buf, uint64(offset))
+	}
+
+	buf.Write(packSha)
+	idxSha := sha1.Sum(buf.Bytes())
+	buf.Write(idxSha[:])
+
+	idxPath := packPath[:len(packPath)-len(".pack")] + ".idx"
+	return os.WriteFile(idxPath, buf.Bytes(), 0644)
+}
+
+func writeUint32BigEndian(buf *bytes.Buffer, v uint32) {
+	buf.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func writeUint64BigEndian(buf *bytes.Buffer, v uint64) {
+	writeUint32BigEndian(buf, uint32(v>>32))
+	writeUint32BigEndian(buf, uint32(v))
+}
+
+type PackIndex struct {
+	hashes  [][]byte
+	offsets []int64
+}
+
+func NewPackIndex(idxPath string) (*PackIndex, error) {
+	data, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, fmt.Errorf("error on reading idx file: %v", err)
+	}
+	if len(data) < 8 || !bytes.Equal(data[0:4], idxMagic) {
+		return nil, errors.New("invalid idx header")
+	}
+	if readUint32BigEndian(data[4:8]) != 2 {
+		return nil, errors.New("unsupported idx version")
+	}
+
+	fanoutStart := 8
+	fanout := make([]uint32, 256)
+	for i := range fanout {
+		fanout[i] = readUint32BigEndian(data[fanoutStart+i*4:])
+	}
+	numObjects := fanout[255]
+
+	shaStart := fanoutStart + 256*4
+	crcStart := shaStart + int(numObjects)*20
+	offsetStart := crcStart + int(numObjects)*4
+	bigOffsetStart := offsetStart + int(numObjects)*4
+
+	index := &PackIndex{
+		hashes:  make([][]byte, numObjects),
+		offsets: make([]int64, numObjects),
+	}
+	for i := 0; i < int(numObjects); i++ {
+		index.hashes[i] = data[shaStart+i*20 : shaStart+i*20+20]
+		rawOffset := readUint32BigEndian(data[offsetStart+i*4:])
+		if rawOffset&0x80000000 != 0 {
+			bigIdx := int(rawOffset &^ 0x80000000)
+			index.offsets[i] = int64(readUint64BigEndian(data[bigOffsetStart+bigIdx*8:]))
+		} else {
+			index.offsets[i] = int64(rawOffset)
+		}
+	}
+	return index, nil
+}
+
+func (idx *PackIndex) Lookup(hash string) (int64, error) {
+	want, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0, err
+	}
+	i := sort.Search(len(idx.hashes), func(i int) bool {
+		return bytes.Compare(idx.hashes[i], want) >= 0
+	})
+	if i >= len(idx.hashes) || !bytes.Equal(idx.hashes[i], want) {
+		return 0, errors.New("object not found in pack index")
+	}
+	return idx.offsets[i], nil
+}
+
+func readUint64BigEndian(b []byte) uint64 {
+	return uint64(readUint32BigEndian(b))<<32 | uint64(readUint32BigEndian(b[4:]))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func writeRefs(remoteUrl string, refs map[string]string, defaultBranch string) error {
+	branches := map[string]string{}
+	for ref, hash := range refs {
+		name, ok := strings.CutPrefix(ref, "refs/heads/")
+		if !ok {
+			continue
+		}
+		branches[name] = hash
+		if err := writeRef(filepath.Join(".git/refs/remotes/origin", name), hash); err != nil {
+			return err
+		}
+	}
+
+	if defaultBranch == "" {
+		defaultBranch = "master"
+	}
+	hash, ok := branches[defaultBranch]
+	if !ok {
+		for name, h := range branches {
+			defaultBranch, hash, ok = name, h, true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("default branch %q not found among remote refs", defaultBranch)
+	}
+
+	if err := writeRef(filepath.Join(".git/refs/heads", defaultBranch), hash); err != nil {
+		return err
+	}
+	if err := os.WriteFile(".git/HEAD", []byte(fmt.Sprintf("ref: refs/heads/%s\n", defaultBranch)), 0644); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+
+	return writeRemoteConfig(remoteUrl, defaultBranch)
+}
+
+func writeRef(path string, hash string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(hash+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
+
+func writeRemoteConfig(remoteUrl string, defaultBranch string) error {
+	config := fmt.Sprintf(`[core]
+	repositoryformatversion = 0
+	filemode = true
+	bare = false
+	logallrefupdates = true
+[remote "origin"]
+	url = %s
+	fetch = +refs/heads/*:refs/remotes/origin/*
+[branch "%s"]
+	remote = origin
+	merge = refs/heads/%s
+`, remoteUrl, defaultBranch, defaultBranch)
+
+	if err := os.WriteFile(".git/config", []byte(config), 0644); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
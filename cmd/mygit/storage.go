@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type Storage interface {
+	HasObject(hash string) bool
+	GetObject(hash string) ([]byte, string, error)
+	PutObject(objectType string, content []byte) ([]byte, error)
+}
+
+var objectStorage Storage = detectObjectStorage()
+
+func detectObjectStorage() Storage {
+	packed := findPackedStorage()
+	if packed == nil {
+		return looseStorage{}
+	}
+	return compositeStorage{packed: packed}
+}
+
+func findPackedStorage() *packedStorage {
+	matches, err := filepath.Glob(".git/objects/pack/*.idx")
+	if err != nil || len(matches) == 0 {
+		return nil
+	}
+	idxPath := matches[0]
+	index, err := NewPackIndex(idxPath)
+	if err != nil {
+		return nil
+	}
+	packPath := idxPath[:len(idxPath)-len(".idx")] + ".pack"
+	return newPackedStorage(packPath, index)
+}
+
+type compositeStorage struct {
+	loose  looseStorage
+	packed *packedStorage
+}
+
+func (s compositeStorage) HasObject(hash string) bool {
+	return s.loose.HasObject(hash) || (s.packed != nil && s.packed.HasObject(hash))
+}
+
+func (s compositeStorage) GetObject(hash string) ([]byte, string, error) {
+	if s.loose.HasObject(hash) {
+		return s.loose.GetObject(hash)
+	}
+	if s.packed != nil {
+		return s.packed.GetObject(hash)
+	}
+	return nil, "", fmt.Errorf("object not found: %s", hash)
+}
+
+func (s compositeStorage) PutObject(objectType string, content []byte) ([]byte, error) {
+	return s.loose.PutObject(objectType, content)
+}
+
+type looseStorage struct{}
+
+func (looseStorage) HasObject(hash string) bool {
+	dir, file := splitDirFile(hash)
+	_, err := os.Stat(filepath.Join(".git/objects", dir, file))
+	return err == nil
+}
+
+func (looseStorage) GetObject(hash string) ([]byte, string, error) {
+	dir, file := splitDirFile(hash)
+	b, err := os.ReadFile(filepath.Join(".git/objects", dir, file))
+	if err != nil {
+		return nil, "", fmt.Errorf("error on reading object file: %v", err)
+	}
+
+	raw, err := unzip(b)
+	if err != nil {
+		return nil, "", fmt.Errorf("error on unzipping object file: %v", err)
+	}
+
+	idx := bytes.IndexByte(raw, 0)
+	if idx < 0 {
+		return nil, "", errors.New("bad object header")
+	}
+	var objectType string
+	var size int
+	fmt.Sscanf(string(raw[:idx]), "%s %d", &objectType, &size)
+	content := raw[idx+1:]
+	if len(content) != size {
+		return nil, "", errors.New("bad object size")
+	}
+	return content, objectType, nil
+}
+
+func (looseStorage) PutObject(objectType string, content []byte) ([]byte, error) {
+	header := fmt.Sprintf("%s %d\x00", objectType, len(content))
+	objectData := append([]byte(header), content...)
+
+	zippedData, err := zip(objectData)
+	if err != nil {
+		return nil, fmt.Errorf("error on zipping object: %v", err)
+	}
+
+	object := hash(objectData)
+	dir, file := splitDirFile(hexDump(object))
+	if err := os.Mkdir(filepath.Join(".git/objects", dir), 0644); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("error on creating object dir: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(".git/objects", dir, file), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error on opening object file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := io.CopyBuffer(f, bytes.NewReader(zippedData), make([]byte, 512)); err != nil {
+		return nil, fmt.Errorf("error on writing object file: %v", err)
+	}
+
+	return object, nil
+}
+
+type objectLRU struct {
+	capacity int
+	order    []string
+	entries  map[string]resolvedObject
+}
+
+func newObjectLRU(capacity int) *objectLRU {
+	return &objectLRU{capacity: capacity, entries: map[string]resolvedObject{}}
+}
+
+func (c *objectLRU) get(hash string) (resolvedObject, bool) {
+	obj, ok := c.entries[hash]
+	if !ok {
+		return resolvedObject{}, false
+	}
+	c.touch(hash)
+	return obj, true
+}
+
+func (c *objectLRU) put(hash string, obj resolvedObject) {
+	if _, exists := c.entries[hash]; !exists && len(c.order) >= c.capacity {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.entries, oldest)
+	}
+	c.entries[hash] = obj
+	c.touch(hash)
+}
+
+func (c *objectLRU) touch(hash string) {
+	for i, h := range c.order {
+		if h == hash {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, hash)
+}
+
+type packedStorage struct {
+	packPath string
+	index    *PackIndex
+	cache    *objectLRU
+}
+
+func newPackedStorage(packPath string, index *PackIndex) *packedStorage {
+	return &packedStorage{packPath: packPath, index: index, cache: newObjectLRU(256)}
+}
+
+func (p *packedStorage) HasObject(hash string) bool {
+	_, err := p.index.Lookup(hash)
+	return err == nil
+}
+
+func (p *packedStorage) GetObject(hash string) ([]byte, string, error) {
+	if obj, ok := p.cache.get(hash); ok {
+		return obj.data, obj.objectType, nil
+	}
+	offset, err := p.index.Lookup(hash)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(p.packPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	obj, err := p.readAt(f, offset)
+	if err != nil {
+		return nil, "", err
+	}
+	p.cache.put(hash, obj)
+	return obj.data, obj.objectType, nil
+}
+
+func (p *packedStorage) readAt(f *os.File, offset int64) (resolvedObject, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return resolvedObject{}, err
+	}
+	section := io.NewSectionReader(f, offset, fi.Size()-offset)
+	br := bufio.NewReader(section)
+
+	size, objectType, err := readObjectHeaderFrom(br)
+	if err != nil {
+		return resolvedObject{}, err
+	}
+
+	var baseOffset int64
+	var baseHash string
+	switch objectType {
+	case OBJ_OFS_DELTA:
+		ofs, err := readOfsDeltaOffsetFrom(br)
+		if err != nil {
+			return resolvedObject{}, err
+		}
+		baseOffset = offset - int64(ofs)
+	case OBJ_REF_DELTA:
+		hashBuf := make([]byte, 20)
+		if _, err := io.ReadFull(br, hashBuf); err != nil {
+			return resolvedObject{}, err
+		}
+		baseHash = hexDump(hashBuf)
+	}
+
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return resolvedObject{}, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return resolvedObject{}, err
+	}
+
+	switch objectType {
+	case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
+		if uint64(len(data)) != size {
+			return resolvedObject{}, errors.New("bad object header length")
+		}
+		return resolvedObject{objectType: objectTypeName(objectType), data: data}, nil
+	case OBJ_OFS_DELTA:
+		base, err := p.readAt(f, baseOffset)
+		if err != nil {
+			return resolvedObject{}, err
+		}
+		resolved, err := applyDelta(base.data, data)
+		if err != nil {
+			return resolvedObject{}, err
+		}
+		return resolvedObject{objectType: base.objectType, data: resolved}, nil
+	case OBJ_REF_DELTA:
+		baseData, baseType, err := p.GetObject(baseHash)
+		if err != nil {
+			return resolvedObject{}, err
+		}
+		resolved, err := applyDelta(baseData, data)
+		if err != nil {
+			return resolvedObject{}, err
+		}
+		return resolvedObject{objectType: baseType, data: resolved}, nil
+	default:
+		return resolvedObject{}, errors.New("invalid object type")
+	}
+}
+
+func (p *packedStorage) PutObject(objectType string, content []byte) ([]byte, error) {
+	return nil, errors.New("packedStorage is read-only")
+}
+
+func objectTypeName(t ObjectType) string {
+	return map[ObjectType]string{
+		OBJ_COMMIT: "commit",
+		OBJ_TREE:   "tree",
+		OBJ_BLOB:   "blob",
+		OBJ_TAG:    "tag",
+	}[t]
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type pktLineKind int
+
+const (
+	pktData pktLineKind = iota
+	pktFlush
+	pktDelim
+	pktResponseEnd
+)
+
+type pktLine struct {
+	kind pktLineKind
+	data []byte
+}
+
+func readPktLine(blob []byte) (int, pktLineKind, []byte, error) {
+	if len(blob) < 4 {
+		return 0, 0, nil, errors.New("error reading pkt line")
+	}
+	dst := [2]byte{}
+	if _, err := hex.Decode(dst[:], blob[:4]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := uint16(dst[0])<<8 | uint16(dst[1])
+	switch size {
+	case 0:
+		return 4, pktFlush, nil, nil
+	case 1:
+		return 4, pktDelim, nil, nil
+	case 2:
+		return 4, pktResponseEnd, nil, nil
+	}
+	if len(blob) < int(size) {
+		return 0, 0, nil, errors.New("error reading pkt line")
+	}
+	data := blob[4:size]
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+	return int(size), pktData, data, nil
+}
+
+func splitPktLines(blob []byte) ([]pktLine, error) {
+	lines := []pktLine{}
+	for len(blob) > 0 {
+		n, kind, data, err := readPktLine(blob)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, pktLine{kind: kind, data: data})
+		blob = blob[n:]
+	}
+	return lines, nil
+}
+
+func readPktLineFromReader(r *bufio.Reader) ([]byte, error) {
+	lengthHex := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthHex); err != nil {
+		return nil, err
+	}
+	dst := [2]byte{}
+	if _, err := hex.Decode(dst[:], lengthHex); err != nil {
+		return nil, err
+	}
+	size := uint16(dst[0])<<8 | uint16(dst[1])
+	if size <= 4 {
+		return []byte{}, nil
+	}
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+	return data, nil
+}
+
+func encodePktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+const pktFlushLine = "0000"
+
+type UploadPackSession struct {
+	cloneUrl      string
+	v2            bool
+	capabilities  map[string]string
+	refs          map[string]string
+	defaultBranch string
+}
+
+func NewUploadPackSession(cloneUrl string) (*UploadPackSession, error) {
+	s := &UploadPackSession{cloneUrl: cloneUrl, capabilities: map[string]string{}, refs: map[string]string{}}
+	if err := s.discover(); err != nil {
+		return nil, err
+	}
+	if s.v2 {
+		if err := s.lsRefs(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *UploadPackSession) discover() error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/info/refs?service=git-upload-pack", s.cloneUrl), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	buffer := bytes.Buffer{}
+	io.Copy(&buffer, response.Body)
+	lines, err := splitPktLines(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return errors.New("empty ref discovery response")
+	}
+	if lines[0].kind == pktData && string(lines[0].data) == "# service=git-upload-pack" {
+		lines = lines[1:]
+		if len(lines) > 0 && lines[0].kind == pktFlush {
+			lines = lines[1:]
+		}
+	}
+
+	if len(lines) > 0 && lines[0].kind == pktData && string(lines[0].data) == "version 2" {
+		s.v2 = true
+		for _, line := range lines[1:] {
+			if line.kind != pktData {
+				break
+			}
+			key, value, _ := strings.Cut(string(line.data), "=")
+			s.capabilities[key] = value
+		}
+		return nil
+	}
+
+	for i, line := range lines {
+		if line.kind != pktData || len(line.data) == 0 {
+			continue
+		}
+		entry := line.data
+		if i == 0 {
+			if idx := bytes.IndexByte(entry, 0); idx >= 0 {
+				for _, capability := range strings.Fields(string(entry[idx+1:])) {
+					key, value, _ := strings.Cut(capability, "=")
+					s.capabilities[key] = value
+				}
+				entry = entry[:idx]
+			}
+		}
+		var hash, ref string
+		fmt.Sscanf(string(entry), "%s %s", &hash, &ref)
+		if ref != "" {
+			s.refs[ref] = hash
+		}
+	}
+	if symref, ok := s.capabilities["symref"]; ok {
+		if _, target, found := strings.Cut(symref, ":"); found {
+			s.defaultBranch = strings.TrimPrefix(target, "refs/heads/")
+		}
+	}
+	return nil
+}
+
+func (s *UploadPackSession) lsRefs() error {
+	body := encodePktLine("command=ls-refs\n") +
+		"0001" +
+		encodePktLine("symrefs\n") +
+		encodePktLine("peel\n") +
+		pktFlushLine
+
+	response, err := s.post(body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	buffer := bytes.Buffer{}
+	io.Copy(&buffer, response.Body)
+	lines, err := splitPktLines(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if line.kind != pktData {
+			continue
+		}
+		fields := strings.Fields(string(line.data))
+		if len(fields) < 2 {
+			continue
+		}
+		hash, ref := fields[0], fields[1]
+		s.refs[ref] = hash
+		for _, attr := range fields[2:] {
+			if target, found := strings.CutPrefix(attr, "symref-target:"); found && ref == "HEAD" {
+				s.defaultBranch = strings.TrimPrefix(target, "refs/heads/")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *UploadPackSession) post(body string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/git-upload-pack", s.cloneUrl), bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Git-Protocol", "version=2")
+	return http.DefaultClient.Do(req)
+}
+
+func (s *UploadPackSession) Refs() (map[string]string, string) {
+	return s.refs, s.defaultBranch
+}
+
+func (s *UploadPackSession) FetchPackfile(want string) (io.ReadCloser, error) {
+	if s.v2 {
+		return s.fetchV2(want)
+	}
+	return s.fetchV0(want)
+}
+
+func (s *UploadPackSession) fetchV2(want string) (io.ReadCloser, error) {
+	body := encodePktLine("command=fetch\n") +
+		"0001" +
+		encodePktLine("thin-pack\n") +
+		encodePktLine("ofs-delta\n") +
+		encodePktLine(fmt.Sprintf("want %s\n", want)) +
+		encodePktLine("done\n") +
+		pktFlushLine
+
+	response, err := s.post(body)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(response.Body)
+	for {
+		line, err := readPktLineFromReader(reader)
+		if err != nil {
+			response.Body.Close()
+			return nil, err
+		}
+		if string(line) == "packfile" {
+			break
+		}
+	}
+	return &sidebandDemuxer{r: reader, closer: response.Body}, nil
+}
+
+func (s *UploadPackSession) fetchV0(want string) (io.ReadCloser, error) {
+	body := bytes.NewBufferString(fmt.Sprintf("0032want %s\n00000009done\n", want))
+	response, err := http.Post(fmt.Sprintf("%s/git-upload-pack", s.cloneUrl), "application/x-git-upload-pack-request", body)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(response.Body)
+	if _, err := readPktLineFromReader(reader); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return &packfileBody{r: reader, closer: response.Body}, nil
+}
+
+type sidebandDemuxer struct {
+	r       *bufio.Reader
+	closer  io.Closer
+	pending []byte
+}
+
+func (d *sidebandDemuxer) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		line, err := readPktLineFromReader(d.r)
+		if err != nil {
+			return 0, err
+		}
+		if len(line) == 0 {
+			return 0, io.EOF
+		}
+		switch line[0] {
+		case 1:
+			d.pending = line[1:]
+		case 2:
+			fmt.Fprint(os.Stderr, string(line[1:]))
+		case 3:
+			return 0, fmt.Errorf("remote error: %s", line[1:])
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *sidebandDemuxer) Close() error {
+	return d.closer.Close()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestNewUploadPackSessionDetectsV2 builds a realistic smart-HTTP v2
+// /info/refs response ("# service=..." + flush + "version 2" +
+// capabilities) and checks discover() strips the service announcement
+// before looking for the version line, so v2 is actually detected.
+func TestNewUploadPackSessionDetectsV2(t *testing.T) {
+	body := encodePktLine("# service=git-upload-pack\n") +
+		pktFlushLine +
+		encodePktLine("version 2\n") +
+		encodePktLine("ls-refs=unborn\n") +
+		encodePktLine("fetch=shallow wait-for-done\n") +
+		pktFlushLine
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Write([]byte(pktFlushLine))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	session, err := NewUploadPackSession(server.URL)
+	if err != nil {
+		t.Fatalf("NewUploadPackSession: %v", err)
+	}
+	if !session.v2 {
+		t.Fatal("session.v2 = false, want true")
+	}
+	if _, ok := session.capabilities["ls-refs"]; !ok {
+		t.Fatal("capabilities missing ls-refs")
+	}
+	if _, ok := session.capabilities["fetch"]; !ok {
+		t.Fatal("capabilities missing fetch")
+	}
+}